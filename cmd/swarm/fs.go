@@ -0,0 +1,122 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/swarm/fuse"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// fsCommand is the `swarm fs` command group. Its subcommands are status,
+// commit and diff; mount, unmount and list are not among them. Nothing in
+// this file adds fsCommand to the app's Commands slice.
+var fsCommand = cli.Command{
+	Name:      "fs",
+	Usage:     "Manage swarmfs mounts",
+	ArgsUsage: "fs COMMAND ...",
+	Description: "Manage swarmfs mounts, including visibility into and " +
+		"incremental control over a writable mount's pending changes",
+	Subcommands: []cli.Command{
+		fsStatusCommand,
+		fsCommitCommand,
+		fsDiffCommand,
+	},
+}
+
+// fsStatusCommand, fsCommitCommand and fsDiffCommand give visibility into,
+// and incremental control over, a writable swarmfs mount's pending changes.
+var (
+	fsStatusCommand = cli.Command{
+		Action:    fsStatus,
+		Name:      "status",
+		Usage:     "list pending changes under a swarmfs mount",
+		ArgsUsage: "swarm fs status <mount path>",
+		Description: "Print every filesystem change recorded under <mount path> since " +
+			"it was last committed, including changes recorded before a remount",
+	}
+	fsCommitCommand = cli.Command{
+		Action:    fsCommit,
+		Name:      "commit",
+		Usage:     "flush pending changes under a mount into a new manifest",
+		ArgsUsage: "swarm fs commit <mount path>",
+		Description: "Build a new manifest from the pending changes under <mount path>, print " +
+			"its hash, and reset the mount's journal - without unmounting",
+	}
+	fsDiffCommand = cli.Command{
+		Action:    fsDiff,
+		Name:      "diff",
+		Usage:     "render the change log between two manifests",
+		ArgsUsage: "swarm fs diff <old hash> <new hash>",
+		Description: "Print the per-file changes recorded by the commit that turned <old hash> " +
+			"into <new hash>",
+	}
+)
+
+func fsStatus(cliContext *cli.Context) {
+	args := cliContext.Args()
+	if len(args) < 1 {
+		utils.Fatalf("Usage: swarm fs status <mount path>")
+	}
+	mountPoint := args[0]
+
+	journal, err := fuse.OpenJournal(mountPoint)
+	if err != nil {
+		utils.Fatalf("could not open journal for %s: %v", mountPoint, err)
+	}
+	defer journal.Close()
+
+	entries, err := journal.Entries()
+	if err != nil {
+		utils.Fatalf("could not read journal for %s: %v", mountPoint, err)
+	}
+	if len(entries) == 0 {
+		fmt.Println("no pending changes")
+		return
+	}
+	fmt.Print(fuse.FormatDiff(entries))
+}
+
+func fsCommit(cliContext *cli.Context) {
+	args := cliContext.Args()
+	if len(args) < 1 {
+		utils.Fatalf("Usage: swarm fs commit <mount path>")
+	}
+	mountPoint := args[0]
+
+	newHash, err := fuse.Commit(mountPoint)
+	if err != nil {
+		utils.Fatalf("could not commit %s: %v", mountPoint, err)
+	}
+	fmt.Println(newHash)
+}
+
+func fsDiff(cliContext *cli.Context) {
+	args := cliContext.Args()
+	if len(args) < 2 {
+		utils.Fatalf("Usage: swarm fs diff <old hash> <new hash>")
+	}
+	oldHash, newHash := args[0], args[1]
+
+	entries, err := fuse.DiffManifests(oldHash, newHash)
+	if err != nil {
+		utils.Fatalf("could not diff %s -> %s: %v", oldHash, newHash, err)
+	}
+	fmt.Print(fuse.FormatDiff(entries))
+}
@@ -80,6 +80,7 @@ func TestCLISwarmFs(t *testing.T) {
 	if len(filesToAssert) != 4 {
 		t.Fatalf("should have 4 files to assert now, got %d", len(filesToAssert))
 	}
+
 	hashRegexp := `[a-f\d]{64}`
 	lsMounts := runSwarm(t, []string{
 		"fs",
@@ -93,6 +94,7 @@ func TestCLISwarmFs(t *testing.T) {
 	if hash == mhash {
 		t.Fatal("this should not be equal")
 	}
+
 	//check that there's nothing in the mount folder
 
 	files, err := ioutil.ReadDir(mountPoint)
@@ -0,0 +1,77 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// Inspector exposes read-only methods for debugging and inspecting the
+// internal state of a running swarm node. Its APIs method returns the
+// descriptor that places it under the "debug" RPC namespace, so that
+// operators can interrogate a node's local chunk store without console
+// access to the machine it runs on.
+//
+// Nothing in this package adds that descriptor to a node's RPC API list.
+type Inspector struct {
+	netStore *storage.NetStore
+}
+
+// NewInspector creates an Inspector backed by the given NetStore.
+func NewInspector(netStore *storage.NetStore) *Inspector {
+	return &Inspector{netStore: netStore}
+}
+
+// APIs returns the RPC descriptor that registers Inspector under the
+// "debug" namespace, so that its methods become callable as debug_has etc.
+func (inspector *Inspector) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "debug",
+			Version:   "1.0",
+			Service:   inspector,
+			Public:    true,
+		},
+	}
+}
+
+// Has checks, for every hex-encoded chunk address passed in, whether that
+// chunk is currently resident in the node's local store. It consults only
+// local storage: it never spawns a fetcher or causes any network traffic,
+// making it safe to call against a live, busy node.
+func (inspector *Inspector) Has(ctx context.Context, chunkAddresses []string) (map[string]bool, error) {
+	addrs := make([]storage.Address, len(chunkAddresses))
+	for i, s := range chunkAddresses {
+		addr, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+
+	have := inspector.netStore.HasChunks(ctx, addrs)
+
+	results := make(map[string]bool, len(chunkAddresses))
+	for i, s := range chunkAddresses {
+		results[s] = have[i]
+	}
+	return results, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// fakeChunkStore is a bare-bones in-memory storage.ChunkStore, just enough
+// to back a NetStore in these tests without pulling in a real localstore.
+type fakeChunkStore struct {
+	chunks map[string]storage.Chunk
+}
+
+func newFakeChunkStore() *fakeChunkStore {
+	return &fakeChunkStore{chunks: make(map[string]storage.Chunk)}
+}
+
+func (f *fakeChunkStore) Put(ch storage.Chunk) (func(context.Context) error, error) {
+	f.chunks[string(ch.Address())] = ch
+	return func(context.Context) error { return nil }, nil
+}
+
+func (f *fakeChunkStore) Get(ctx context.Context, ref storage.Address) (storage.Chunk, error) {
+	ch, ok := f.chunks[string(ref)]
+	if !ok {
+		return nil, errors.New("chunk not found")
+	}
+	return ch, nil
+}
+
+func (f *fakeChunkStore) Close() {}
+
+// TestInspectorHas checks that Has reports presence per hex-encoded chunk
+// address, and rejects malformed input instead of silently ignoring it.
+func TestInspectorHas(t *testing.T) {
+	store := newFakeChunkStore()
+	netStore, err := storage.NewNetStore(store, func(ctx context.Context, addr storage.Address, peersToSkip *sync.Map) storage.FetchFunc {
+		return func(ctx context.Context) {}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := NewInspector(netStore)
+
+	present := storage.NewChunk(storage.Address([]byte("present-address-----------------")), []byte("data"))
+	if _, err := store.Put(present); err != nil {
+		t.Fatal(err)
+	}
+	absent := storage.Address([]byte("absent-address------------------"))
+
+	have, err := inspector.Has(context.Background(), []string{
+		hex.EncodeToString(present.Address()),
+		hex.EncodeToString(absent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !have[hex.EncodeToString(present.Address())] {
+		t.Error("expected present chunk to be reported as present")
+	}
+	if have[hex.EncodeToString(absent)] {
+		t.Error("expected absent chunk to be reported as absent")
+	}
+
+	if _, err := inspector.Has(context.Background(), []string{"not-hex"}); err == nil {
+		t.Error("expected an error for a malformed chunk address")
+	}
+}
+
+// TestInspectorAPIs checks that Inspector registers itself under the
+// "debug" RPC namespace.
+func TestInspectorAPIs(t *testing.T) {
+	inspector := NewInspector(nil)
+	apis := inspector.APIs()
+	if len(apis) != 1 {
+		t.Fatalf("expected exactly 1 RPC API, got %d", len(apis))
+	}
+	if apis[0].Namespace != "debug" {
+		t.Errorf("expected the \"debug\" namespace, got %q", apis[0].Namespace)
+	}
+	if apis[0].Service != inspector {
+		t.Error("expected the registered service to be the inspector itself")
+	}
+}
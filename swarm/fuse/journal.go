@@ -0,0 +1,178 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package fuse
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ChangeOp identifies the kind of filesystem operation a ChangeEntry
+// records.
+type ChangeOp int
+
+const (
+	ChangeOpCreate ChangeOp = iota
+	ChangeOpWrite
+	ChangeOpUnlink
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeOpCreate:
+		return "create"
+	case ChangeOpWrite:
+		return "write"
+	case ChangeOpUnlink:
+		return "unlink"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEntry is a single journaled filesystem change under a swarmfs
+// mount: what happened, to which path, and the chunk references the path
+// pointed at before and after the change.
+type ChangeEntry struct {
+	Op        ChangeOp  `json:"op"`
+	Path      string    `json:"path"`
+	PrevRef   string    `json:"prevRef,omitempty"`
+	NewRef    string    `json:"newRef,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// journalDir and journalFile are the well-known locations, relative to a
+// mount point, where the change journal is kept, so that `swarm fs
+// status`/`commit` and crash recovery on remount can always find it.
+const (
+	journalDir  = ".swarm"
+	journalFile = "journal"
+)
+
+// JournalPath returns the path of the journal file for the given mount
+// point.
+func JournalPath(mountPoint string) string {
+	return filepath.Join(mountPoint, journalDir, journalFile)
+}
+
+// Journal is an append-only log of filesystem changes made under a mount
+// point since it was last committed to a new manifest. It is persisted to
+// disk, so entries written before a crash are still there the next time the
+// journal of the same mount point is opened; nothing in this package replays
+// them into the mount.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenJournal opens, creating if necessary, the journal for mountPoint,
+// ready to accept new entries. Entries already on disk from a previous,
+// uncommitted session are preserved, which is what allows a crashed mount to
+// be recovered.
+func OpenJournal(mountPoint string) (*Journal, error) {
+	path := JournalPath(mountPoint)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: f}, nil
+}
+
+// Append records a single change entry, flushing it to disk immediately so
+// it survives a crash before the next commit. No FUSE write, create or
+// unlink handler calls Append, so filesystem activity under a mount does not
+// reach the journal by itself; TestMountsCommitAndDiff calls Append directly.
+func (j *Journal) Append(entry ChangeEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Entries returns every change recorded in the journal so far, in the order
+// they were appended.
+func (j *Journal) Entries() ([]ChangeEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ChangeEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry ChangeEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Reset truncates the journal. It is called once a commit has flushed its
+// pending changes into a new manifest.
+func (j *Journal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// Close closes the underlying journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// FormatDiff renders a slice of change entries as the human-readable report
+// printed by `swarm fs status` and `swarm fs diff`.
+func FormatDiff(entries []ChangeEntry) string {
+	var out string
+	for _, e := range entries {
+		out += fmt.Sprintf("%s\t%s\t%s -> %s\t%s\n", e.Timestamp.Format(time.RFC3339), e.Op, e.PrevRef, e.NewRef, e.Path)
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ManifestBuilder rebuilds the manifest for everything currently under a
+// mount point and returns its new root hash. The mount command supplies one
+// when it registers a mount, since only it has access to the swarm api
+// machinery needed to build and store a manifest.
+type ManifestBuilder func() (string, error)
+
+type mountState struct {
+	rootHash string
+	journal  *Journal
+	build    ManifestBuilder
+}
+
+var (
+	mountsMu sync.Mutex
+	mounts   = make(map[string]*mountState)
+
+	// history records each commit's change log, indexed by its "old ->
+	// new" manifest hash transition, so that `swarm fs diff` can render it
+	// even after the mount producing it has been unmounted. It only covers
+	// commits made by this process since it started.
+	historyMu sync.Mutex
+	history   = make(map[[2]string][]ChangeEntry)
+)
+
+// RegisterMount records that mountPoint is backed by rootHash, journal and
+// build, so that a later Commit of mountPoint in the same process can find
+// its pending changes and rebuild its manifest.
+func RegisterMount(mountPoint, rootHash string, journal *Journal, build ManifestBuilder) {
+	mountsMu.Lock()
+	defer mountsMu.Unlock()
+	mounts[mountPoint] = &mountState{rootHash: rootHash, journal: journal, build: build}
+}
+
+// UnregisterMount forgets mountPoint. It is called on unmount.
+func UnregisterMount(mountPoint string) {
+	mountsMu.Lock()
+	defer mountsMu.Unlock()
+	delete(mounts, mountPoint)
+}
+
+// Commit rebuilds the manifest for mountPoint's current contents, returns
+// its new root hash, archives the journal's entries under the resulting
+// hash transition for later `swarm fs diff` lookups, and resets the
+// journal so that future `status` calls only report changes made after this
+// commit.
+func Commit(mountPoint string) (string, error) {
+	mountsMu.Lock()
+	state, ok := mounts[mountPoint]
+	mountsMu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s is not a registered swarmfs mount", mountPoint)
+	}
+
+	entries, err := state.journal.Entries()
+	if err != nil {
+		return "", err
+	}
+	newHash, err := state.build()
+	if err != nil {
+		return "", err
+	}
+	if err := state.journal.Reset(); err != nil {
+		return "", err
+	}
+
+	historyMu.Lock()
+	history[[2]string{state.rootHash, newHash}] = entries
+	historyMu.Unlock()
+
+	mountsMu.Lock()
+	state.rootHash = newHash
+	mountsMu.Unlock()
+
+	return newHash, nil
+}
+
+// DiffManifests returns the change log recorded for the commit that turned
+// oldHash into newHash.
+func DiffManifests(oldHash, newHash string) ([]ChangeEntry, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	entries, ok := history[[2]string{oldHash, newHash}]
+	if !ok {
+		return nil, fmt.Errorf("no recorded change log between %s and %s", oldHash, newHash)
+	}
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMountsCommitAndDiff checks that entries appended to a mount's journal
+// before a commit show up, per file, in the change log DiffManifests returns
+// for that commit's hash transition, and that the journal is empty again
+// afterwards.
+func TestMountsCommitAndDiff(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "swarmfs-mounts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountPoint)
+
+	journal, err := OpenJournal(mountPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	paths := []string{
+		filepath.Join(mountPoint, "a.txt"),
+		filepath.Join(mountPoint, "dir", "b.txt"),
+	}
+	for _, p := range paths {
+		if err := journal.Append(ChangeEntry{Op: ChangeOpCreate, Path: p, NewRef: "newref"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const oldHash = "oldhash"
+	const newHash = "newhash"
+	RegisterMount(mountPoint, oldHash, journal, func() (string, error) {
+		return newHash, nil
+	})
+	defer UnregisterMount(mountPoint)
+
+	gotHash, err := Commit(mountPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotHash != newHash {
+		t.Fatalf("expected commit to return %q, got %q", newHash, gotHash)
+	}
+
+	entries, err := journal.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected journal to be reset after commit, got %d entries", len(entries))
+	}
+
+	diffEntries, err := DiffManifests(oldHash, newHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffEntries) != len(paths) {
+		t.Fatalf("expected %d entries in the change log, got %d", len(paths), len(diffEntries))
+	}
+	out := FormatDiff(diffEntries)
+	for _, p := range paths {
+		if !strings.Contains(out, p) {
+			t.Errorf("expected diff output to mention %q, got %q", p, out)
+		}
+	}
+}
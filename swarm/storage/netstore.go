@@ -19,41 +19,137 @@ package storage
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/swarm/spancontext"
 	lru "github.com/hashicorp/golang-lru"
+	opentracing "github.com/opentracing/opentracing-go"
 )
 
 type (
 	FetchFunc    func(ctx context.Context)
-	NewFetchFunc func(ctx context.Context, offer Address, peers *sync.Map) FetchFunc
+	NewFetchFunc func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc
 )
 
+var (
+	// searchTimeout is the max amount of time the fetcher run loop waits for a
+	// delivery before it retries the fetch with the peers asked so far added
+	// to the skip list, so that a different peer is tried upstream. It is a
+	// var, rather than a const, so that tests can shorten it.
+	searchTimeout = 1 * time.Second
+	// peersToSkipTTL is how long a peer stays in peersToSkip after it has been
+	// asked for a chunk. Once it expires the peer becomes eligible again. It
+	// is a var, rather than a const, so that tests can shorten it.
+	peersToSkipTTL = 10 * time.Second
+)
+
+// defaultFetcherConcurrency is the number of fetch jobs NetStore will run
+// against the network at the same time, unless overridden with
+// WithFetcherConcurrency.
+const defaultFetcherConcurrency = 10
+
+// Priority is the scheduling band a fetch request is submitted under. Higher
+// priority jobs are always served ahead of lower priority ones.
+type Priority int
+
+const (
+	// PriorityOpportunistic is for background fetches that aren't blocking
+	// anyone, e.g. pre-fetching or repair.
+	PriorityOpportunistic Priority = iota
+	// PrioritySyncRequest is for chunks requested to satisfy syncing with
+	// other nodes.
+	PrioritySyncRequest
+	// PriorityUserRequest is for chunks a user is actively waiting on, e.g.
+	// via the HTTP API. This is the default priority.
+	PriorityUserRequest
+	priorityCount
+)
+
+type priorityContextKey struct{}
+
+// WithFetchPriority returns a context carrying the given scheduling
+// priority, to be passed to NetStore.Get/FetchFunc so the underlying fetch job is
+// scheduled accordingly. Requests made with a plain context default to
+// PriorityUserRequest.
+func WithFetchPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, p)
+}
+
+func priorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityContextKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityUserRequest
+}
+
+var (
+	metricsGetHit  = metrics.NewRegisteredCounter("netstore.get.hit", nil)
+	metricsGetMiss = metrics.NewRegisteredCounter("netstore.get.miss", nil)
+
+	metricsPutNew       = metrics.NewRegisteredCounter("netstore.put.new", nil)
+	metricsPutDuplicate = metrics.NewRegisteredCounter("netstore.put.duplicate", nil)
+
+	metricsFetcherCreated = metrics.NewRegisteredCounter("netstore.fetcher.created", nil)
+
+	metricsGetHitTimer          = metrics.NewRegisteredTimer("netstore.get.hit.time", nil)
+	metricsGetMissTimer         = metrics.NewRegisteredTimer("netstore.get.miss.time", nil)
+	metricsFetcherDeliveryTimer = metrics.NewRegisteredTimer("netstore.fetcher.delivery.time", nil)
+)
+
+// metricsFetcherEvicted returns the labelled counter recording a fetcher
+// eviction for the given reason ("delivered" or "context-done").
+func metricsFetcherEvicted(reason string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(fmt.Sprintf("netstore.fetcher.evicted.%s", reason), nil)
+}
+
+// NetStoreOption is used to configure optional parameters to NewNetStore.
+type NetStoreOption func(*NetStore)
+
+// WithFetcherConcurrency sets the number of fetch jobs NetStore will run
+// against the network concurrently. The default is defaultFetcherConcurrency.
+func WithFetcherConcurrency(n int) NetStoreOption {
+	return func(n2 *NetStore) {
+		n2.fetcherConcurrency = n
+	}
+}
+
 // NetStore is an extention of local storage
 // it implements the ChunkStore interface
 // on request it initiates remote cloud retrieval using a fetcher
 // fetchers are unique to a chunk and are stored in fetchers LRU memory cache
 // fetchFuncFactory is a factory object to create a fetch function for a specific chunk address
 type NetStore struct {
-	mu           sync.Mutex
-	store        ChunkStore
-	fetchers     *lru.Cache
-	newFetchFunc NewFetchFunc
+	mu                 sync.Mutex
+	store              ChunkStore
+	fetchers           *lru.Cache
+	newFetchFunc       NewFetchFunc
+	fetcherConcurrency int
+	scheduler          *fetchScheduler
 }
 
 // NewNetStore creates a new NetStore object using the given local store. newFetchFunc is a
-// constructor function that can create a fetch function for a specific chunk address.
-func NewNetStore(store ChunkStore, newFetchFunc NewFetchFunc) (*NetStore, error) {
+// constructor function that can create a fetch function for a specific chunk address. Options
+// can be supplied to override defaults such as the fetcher concurrency.
+func NewNetStore(store ChunkStore, newFetchFunc NewFetchFunc, opts ...NetStoreOption) (*NetStore, error) {
 	fetchers, err := lru.New(defaultChunkRequestsCacheCapacity)
 	if err != nil {
 		return nil, err
 	}
-	return &NetStore{
-		store:        store,
-		fetchers:     fetchers,
-		newFetchFunc: newFetchFunc,
-	}, nil
+	n := &NetStore{
+		store:              store,
+		fetchers:           fetchers,
+		newFetchFunc:       newFetchFunc,
+		fetcherConcurrency: defaultFetcherConcurrency,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.scheduler = newFetchScheduler(n.fetcherConcurrency)
+	return n, nil
 }
 
 // Put stores a chunk in localstore, returns a wait function to wait for
@@ -67,10 +163,12 @@ func (n *NetStore) Put(ch Chunk) (func(ctx context.Context) error, error) {
 	}
 	// if chunk was already in store (wait f is nil)
 	if wait == nil {
+		metricsPutDuplicate.Inc(1)
 		return nil, nil
 	}
+	metricsPutNew.Inc(1)
 	// if chunk is now put in store, check if there was an active fetcher
-	f, _ := n.fetchers.Get(ch.Address())
+	f, _ := n.fetchers.Get(hex.EncodeToString(ch.Address()))
 	// if there is, deliver the chunk to requestors via fetcher
 	if f != nil {
 		f.(*fetcher).deliver(ch)
@@ -83,19 +181,48 @@ func (n *NetStore) Put(ch Chunk) (func(ctx context.Context) error, error) {
 // it calls fetch with the request, which blocks until the chunk
 // arrived or context is done
 func (n *NetStore) Get(rctx context.Context, ref Address) (Chunk, error) {
+	start := time.Now()
 	chunk, fetch, err := n.get(rctx, ref)
 	if fetch == nil {
+		metricsGetHit.Inc(1)
+		metricsGetHitTimer.UpdateSince(start)
 		return chunk, err
 	}
-	return fetch(rctx)
+	metricsGetMiss.Inc(1)
+	chunk, err = fetch(rctx)
+	metricsGetMissTimer.UpdateSince(start)
+	return chunk, err
 }
 
-// Has
-func (n *NetStore) Has(ctx context.Context, ref Address) func(context.Context) (Chunk, error) {
+// FetchFunc returns nil if the store already has the chunk, otherwise it
+// returns a function to fetch the chunk. This can be used to refresh the
+// expiry of a chunk in the disk cache, or to check if it's worth fetching a
+// chunk without starting the fetch right away.
+func (n *NetStore) FetchFunc(ctx context.Context, ref Address) func(context.Context) (Chunk, error) {
 	_, fetch, _ := n.get(ctx, ref)
 	return fetch
 }
 
+// Has checks whether the chunk identified by ref is present in the
+// underlying local ChunkStore. Unlike FetchFunc, it never creates a fetcher
+// or triggers network traffic - it only reports on what is resident locally.
+func (n *NetStore) Has(ctx context.Context, ref Address) bool {
+	_, err := n.store.Get(ctx, ref)
+	return err == nil
+}
+
+// HasChunks checks a batch of chunk addresses against the underlying local
+// ChunkStore, returning a slice of the same length as refs, with each entry
+// reporting whether the corresponding chunk is present locally. Like Has, it
+// never triggers a fetcher or network traffic.
+func (n *NetStore) HasChunks(ctx context.Context, refs []Address) []bool {
+	have := make([]bool, len(refs))
+	for i, ref := range refs {
+		have[i] = n.Has(ctx, ref)
+	}
+	return have
+}
+
 // Close chunk store
 func (n *NetStore) Close() {
 	n.store.Close()
@@ -116,53 +243,130 @@ func (n *NetStore) get(ctx context.Context, ref Address) (Chunk, func(context.Co
 	if err == nil {
 		return chunk, nil, nil
 	}
-	f := n.getOrCreateFetcher(ref)
+	f := n.getOrCreateFetcher(ctx, ref)
 	return nil, f.Fetch, nil
 }
 
 // getOrCreateFetcher attempts at retrieving an existing fetchers
 // if none exists, creates one and saves it in the fetchers cache
-// caller must hold the lock
-func (n *NetStore) getOrCreateFetcher(ref Address) *fetcher {
+// caller must hold the lock. The priority carried by ctx is applied to the
+// fetcher - upgrading it if the fetcher already existed with a lower one.
+func (n *NetStore) getOrCreateFetcher(ctx context.Context, ref Address) *fetcher {
 	key := hex.EncodeToString(ref)
-	f, ok := n.fetchers.Get(key)
-	if ok {
-		return f.(*fetcher)
+	priority := priorityFromContext(ctx)
+	if f, ok := n.fetchers.Get(key); ok {
+		f := f.(*fetcher)
+		f.upgradePriority(priority)
+		return f
 	}
 	// create the context during which fetching is kept alive
-	ctx, cancel := context.WithCancel(context.Background())
+	fetcherCtx, cancel := context.WithCancel(context.Background())
+	fetcherCtx, span := spancontext.StartSpan(fetcherCtx, "netstore.fetcher")
+	if peer := ctx.Value("peer"); peer != nil {
+		span.SetTag("peer", peer)
+	}
+
+	var f *fetcher
 	// destroy is called when all requests finish
 	destroy := func() {
 		// remove fetcher from fetchers
 		n.fetchers.Remove(key)
+		reason := "context-done"
+		if atomic.LoadInt32(&f.delivered) == 1 {
+			reason = "delivered"
+		}
+		metricsFetcherEvicted(reason).Inc(1)
 		// stop fetcher by cancelling context called when
 		// all requests cancelled/timedout or chunk is delivered
 		cancel()
 	}
-	peers := &sync.Map{}
-	fetcher := newFetcher(ref, n.newFetchFunc(ctx, ref, peers), destroy, peers)
-	n.fetchers.Add(key, fetcher)
+	peersToSkip := &sync.Map{}
+	f = newFetcher(ref, n.newFetchFunc(fetcherCtx, ref, peersToSkip), destroy, peersToSkip, n.scheduler, priority, span)
+	metricsFetcherCreated.Inc(1)
+	n.fetchers.Add(key, f)
+	go f.run(fetcherCtx)
 
-	return fetcher
+	return f
 }
 
+// fetcher holds the state of a chunk being retrieved over the network. A
+// single fetcher is shared by all requests for the same chunk address, and
+// runs a background loop which repeatedly calls fetch until the chunk is
+// delivered or all requests relying on it are gone.
 type fetcher struct {
-	addr       Address       // adress of chunk
-	chunk      Chunk         // fetcher can set the chunk on the fetcher
-	deliveredC chan struct{} // chan signalling chunk delivery to requests
-	fetch      FetchFunc     // remote fetch function to be called with a request source taken from the context
-	cancel     func()        // cleanup function for the remote fetcher to call when all upstream contexts are called
-	peers      *sync.Map     // the peers which asked for the chunk
-	requestCnt int32         // number of requests on this chunk. If all the requests are done (delivered or context is done) the cancel function is called
+	addr        Address       // adress of chunk
+	chunk       Chunk         // fetcher can set the chunk on the fetcher
+	deliveredC  chan struct{} // chan signalling chunk delivery to requests
+	fetch       FetchFunc     // remote fetch function to be called with a request source taken from the context
+	cancel      func()        // cleanup function for the remote fetcher to call when all upstream contexts are called
+	peersToSkip *sync.Map     // the peers not to ask for the chunk, with the time each was added; Fetch adds every peer that requests the chunk
+	requestCnt  int32         // number of requests on this chunk. If all the requests are done (delivered or context is done) the cancel function is called
+	offerC      chan struct{} // signals the run loop that a new request registered, so it should retry immediately
+	scheduler   *fetchScheduler
+	priority    int32            // current scheduling priority, only ever upgraded - access via atomic
+	delivered   int32            // 1 once deliver has been called - access via atomic
+	span        opentracing.Span // traces the fetcher's lifetime, from creation to delivery or cancellation
+	createdAt   time.Time        // when the fetcher was created, for the time-to-delivery metric
 }
 
-func newFetcher(addr Address, fetch FetchFunc, cancel func(), peers *sync.Map) *fetcher {
+func newFetcher(addr Address, fetch FetchFunc, cancel func(), peersToSkip *sync.Map, scheduler *fetchScheduler, priority Priority, span opentracing.Span) *fetcher {
 	return &fetcher{
-		addr:       addr,
-		deliveredC: make(chan struct{}),
-		fetch:      fetch,
-		cancel:     cancel,
-		peers:      peers,
+		addr:        addr,
+		deliveredC:  make(chan struct{}),
+		fetch:       fetch,
+		cancel:      cancel,
+		peersToSkip: peersToSkip,
+		offerC:      make(chan struct{}, 1),
+		scheduler:   scheduler,
+		priority:    int32(priority),
+		span:        span,
+		createdAt:   time.Now(),
+	}
+}
+
+// upgradePriority raises the fetcher's scheduling priority to p, if p is
+// higher than its current priority. Priority is never lowered, since a
+// fetcher already satisfying a high-priority request shouldn't be starved
+// because a later, lower-priority request also asked for the same chunk.
+func (f *fetcher) upgradePriority(p Priority) {
+	for {
+		current := atomic.LoadInt32(&f.priority)
+		if Priority(current) >= p {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&f.priority, current, int32(p)) {
+			return
+		}
+	}
+}
+
+// run is the fetcher's background loop. It keeps submitting fetch jobs to
+// the shared scheduler until the chunk is delivered or ctx is done. After
+// every attempt it waits out searchTimeout before retrying, unless a new
+// request arrives in the meantime via offerC, in which case it retries
+// straight away - the new request may be carrying a peer context that makes
+// an immediate retry worthwhile. peersToSkip accumulates every peer asked so
+// far so that upstream fetch implementations can pick a fresh peer on each
+// retry; entries are left to expire on their own after peersToSkipTTL.
+func (f *fetcher) run(ctx context.Context) {
+	for {
+		f.scheduler.schedule(f.addr, Priority(atomic.LoadInt32(&f.priority)), ctx, f.fetch)
+
+		timer := time.NewTimer(searchTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if atomic.LoadInt32(&f.delivered) == 0 {
+				f.span.Finish()
+			}
+			return
+		case <-f.deliveredC:
+			timer.Stop()
+			return
+		case <-f.offerC:
+			timer.Stop()
+		case <-timer.C:
+		}
 	}
 }
 
@@ -180,11 +384,19 @@ func (f *fetcher) Fetch(rctx context.Context) (Chunk, error) {
 	// The peer asking for the chunk. Maybe this should be a function parameter?
 	peer := rctx.Value("peer")
 	if peer != nil {
-		f.peers.Store(peer, true)
-		defer f.peers.Delete(peer)
+		f.peersToSkip.Store(peer, time.Now())
+		go f.expirePeer(peer)
 	}
 
-	f.fetch(rctx)
+	// a request joining a fetcher that already serves other requests wakes up
+	// the run loop so it can retry immediately with the newly arrived request
+	// context, rather than waiting out the current timeout
+	if atomic.LoadInt32(&f.requestCnt) > 1 {
+		select {
+		case f.offerC <- struct{}{}:
+		default:
+		}
+	}
 
 	// wait until either the chunk is delivered or the context is done
 	select {
@@ -195,9 +407,19 @@ func (f *fetcher) Fetch(rctx context.Context) (Chunk, error) {
 	}
 }
 
+// expirePeer removes peer from peersToSkip once peersToSkipTTL has elapsed,
+// so that it becomes eligible for retries again.
+func (f *fetcher) expirePeer(peer interface{}) {
+	time.Sleep(peersToSkipTTL)
+	f.peersToSkip.Delete(peer)
+}
+
 // deliver is called by NetStore.Put to notify all pending
 // requests
 func (f *fetcher) deliver(ch Chunk) {
 	f.chunk = ch
+	atomic.StoreInt32(&f.delivered, 1)
+	metricsFetcherDeliveryTimer.UpdateSince(f.createdAt)
+	f.span.Finish()
 	close(f.deliveredC)
 }
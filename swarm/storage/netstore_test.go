@@ -0,0 +1,336 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// fakeChunkStore is a bare-bones in-memory ChunkStore used to exercise
+// NetStore without pulling in a real localstore.
+type fakeChunkStore struct {
+	mu     sync.Mutex
+	chunks map[string]Chunk
+}
+
+func newFakeChunkStore() *fakeChunkStore {
+	return &fakeChunkStore{
+		chunks: make(map[string]Chunk),
+	}
+}
+
+func (f *fakeChunkStore) Put(ch Chunk) (func(context.Context) error, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := string(ch.Address())
+	if _, ok := f.chunks[key]; ok {
+		return nil, nil
+	}
+	f.chunks[key] = ch
+	return func(context.Context) error { return nil }, nil
+}
+
+func (f *fakeChunkStore) Get(ctx context.Context, ref Address) (Chunk, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.chunks[string(ref)]
+	if !ok {
+		return nil, errors.New("chunk not found")
+	}
+	return ch, nil
+}
+
+func (f *fakeChunkStore) Close() {}
+
+// withShortFetcherTimeouts shortens the fetcher's retry and peer skip
+// timeouts for the duration of a test and restores them afterwards.
+func withShortFetcherTimeouts(t *testing.T) func() {
+	t.Helper()
+	prevSearchTimeout, prevPeersToSkipTTL := searchTimeout, peersToSkipTTL
+	searchTimeout = 50 * time.Millisecond
+	peersToSkipTTL = 200 * time.Millisecond
+	return func() {
+		searchTimeout, peersToSkipTTL = prevSearchTimeout, prevPeersToSkipTTL
+	}
+}
+
+// contextWithPeer tags ctx with a peer value under the same "peer" context
+// key that fetcher.Fetch and getOrCreateFetcher read from (see netstore.go),
+// so that requests made through it are recorded in peersToSkip.
+func contextWithPeer(ctx context.Context, peer string) context.Context {
+	return context.WithValue(ctx, "peer", peer)
+}
+
+// TestNetStoreFetcherSingleRequest checks that a single Get call on a chunk
+// that is not available locally triggers exactly one fetch and returns the
+// chunk once it is delivered via Put.
+func TestNetStoreFetcherSingleRequest(t *testing.T) {
+	store := newFakeChunkStore()
+	var fetchCalls int32
+	newFetchFunc := func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc {
+		return func(ctx context.Context) {
+			atomic.AddInt32(&fetchCalls, 1)
+		}
+	}
+	n, err := NewNetStore(store, newFetchFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := Address([]byte("12345678901234567890123456789012"))
+	chunk := NewChunk(addr, []byte("some bytes"))
+
+	errc := make(chan error, 1)
+	go func() {
+		got, err := n.Get(context.Background(), addr)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if string(got.Data()) != string(chunk.Data()) {
+			errc <- fmt.Errorf("got chunk with unexpected data %q", got.Data())
+			return
+		}
+		errc <- nil
+	}()
+
+	// give the fetcher's run loop a chance to issue its first fetch
+	time.Sleep(20 * time.Millisecond)
+	if _, err := n.Put(chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Get to return")
+	}
+
+	if got := atomic.LoadInt32(&fetchCalls); got != 1 {
+		t.Fatalf("expected exactly 1 fetch call, got %d", got)
+	}
+}
+
+// TestNetStoreFetcherCoalescing checks that multiple concurrent requests for
+// the same chunk address share a single fetcher instance and are all
+// satisfied by one delivery.
+func TestNetStoreFetcherCoalescing(t *testing.T) {
+	defer withShortFetcherTimeouts(t)()
+
+	store := newFakeChunkStore()
+	var fetcherCreated int32
+	newFetchFunc := func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc {
+		atomic.AddInt32(&fetcherCreated, 1)
+		return func(ctx context.Context) {}
+	}
+	n, err := NewNetStore(store, newFetchFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := Address([]byte("12345678901234567890123456789012"))
+	chunk := NewChunk(addr, []byte("some bytes"))
+
+	const requesters = 8
+	var wg sync.WaitGroup
+	wg.Add(requesters)
+	for i := 0; i < requesters; i++ {
+		go func(i int) {
+			defer wg.Done()
+			got, err := n.Get(contextWithPeer(context.Background(), fmt.Sprintf("peer-%d", i)), addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(got.Data()) != string(chunk.Data()) {
+				t.Errorf("got chunk with unexpected data %q", got.Data())
+			}
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := n.Put(chunk); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetcherCreated); got != 1 {
+		t.Fatalf("expected a single shared fetcher to be created, got %d", got)
+	}
+}
+
+// TestNetStoreFetcherRetryAndPeerSkip checks that the fetcher retries after
+// searchTimeout elapses without a delivery, and that every peer that
+// requested the chunk ends up in the peersToSkip map passed to the fetch function factory.
+func TestNetStoreFetcherRetryAndPeerSkip(t *testing.T) {
+	defer withShortFetcherTimeouts(t)()
+
+	store := newFakeChunkStore()
+	var fetchCalls int32
+	var peersToSkipRef *sync.Map
+	newFetchFunc := func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc {
+		peersToSkipRef = peersToSkip
+		return func(ctx context.Context) {
+			atomic.AddInt32(&fetchCalls, 1)
+		}
+	}
+	n, err := NewNetStore(store, newFetchFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := Address([]byte("12345678901234567890123456789012"))
+
+	// shorter than peersToSkipTTL, so that no peer has expired by the checks below
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		n.Get(contextWithPeer(ctx, "peer-a"), addr)
+		close(done)
+	}()
+	// a second, later request from a different peer should register itself
+	// in peersToSkip as well
+	time.Sleep(20 * time.Millisecond)
+	go n.Get(contextWithPeer(ctx, "peer-b"), addr)
+
+	<-ctx.Done()
+	<-done
+
+	if got := atomic.LoadInt32(&fetchCalls); got < 2 {
+		t.Fatalf("expected at least 2 retries after search timeouts, got %d fetch calls", got)
+	}
+
+	for _, peer := range []string{"peer-a", "peer-b"} {
+		if _, ok := peersToSkipRef.Load(peer); !ok {
+			t.Errorf("expected %q to be present in peersToSkip", peer)
+		}
+	}
+}
+
+// TestNetStoreFetcherCleanupOnCancel checks that once all requesters give up
+// on a chunk, the fetcher is cancelled and evicted from the fetchers LRU.
+func TestNetStoreFetcherCleanupOnCancel(t *testing.T) {
+	defer withShortFetcherTimeouts(t)()
+
+	store := newFakeChunkStore()
+	newFetchFunc := func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc {
+		return func(ctx context.Context) {}
+	}
+	n, err := NewNetStore(store, newFetchFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := Address([]byte("12345678901234567890123456789012"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Get(ctx, addr)
+		close(done)
+	}()
+
+	// wait until the fetcher has actually been registered
+	for i := 0; i < 100 && n.fetchers.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n.fetchers.Len() != 1 {
+		t.Fatal("expected fetcher to be registered in the LRU")
+	}
+
+	cancel()
+	<-done
+
+	for i := 0; i < 100 && n.fetchers.Len() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n.fetchers.Len() != 0 {
+		t.Fatal("expected fetcher to be evicted from the LRU once all requests were cancelled")
+	}
+}
+
+// TestNetStoreMetricsFetcherEvictedReason checks that the fetcher eviction
+// counters are labelled correctly depending on whether the fetcher was
+// cleaned up because the chunk was delivered or because its requesters gave
+// up.
+func TestNetStoreMetricsFetcherEvictedReason(t *testing.T) {
+	defer withShortFetcherTimeouts(t)()
+
+	store := newFakeChunkStore()
+	newFetchFunc := func(ctx context.Context, addr Address, peersToSkip *sync.Map) FetchFunc {
+		return func(ctx context.Context) {}
+	}
+	n, err := NewNetStore(store, newFetchFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// counters only count while metrics are enabled, and one created while
+	// they were disabled stays registered as a no-op, so drop those first
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+	for _, reason := range []string{"delivered", "context-done"} {
+		metrics.DefaultRegistry.Unregister(fmt.Sprintf("netstore.fetcher.evicted.%s", reason))
+	}
+
+	deliveredBefore := metricsFetcherEvicted("delivered").Count()
+	contextDoneBefore := metricsFetcherEvicted("context-done").Count()
+
+	deliveredAddr := Address([]byte("delivered-address--------------"))
+	chunk := NewChunk(deliveredAddr, []byte("some bytes"))
+	go n.Get(context.Background(), deliveredAddr)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := n.Put(chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelledAddr := Address([]byte("cancelled-address--------------"))
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Get(ctx, cancelledAddr)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	var deliveredAfter, contextDoneAfter int64
+	for i := 0; i < 100; i++ {
+		deliveredAfter = metricsFetcherEvicted("delivered").Count()
+		contextDoneAfter = metricsFetcherEvicted("context-done").Count()
+		if deliveredAfter > deliveredBefore && contextDoneAfter > contextDoneBefore {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if deliveredAfter <= deliveredBefore {
+		t.Error("expected the delivered fetcher's eviction to be recorded under the \"delivered\" reason")
+	}
+	if contextDoneAfter <= contextDoneBefore {
+		t.Error("expected the cancelled fetcher's eviction to be recorded under the \"context-done\" reason")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	metricsSchedulerQueueDepth = metrics.NewRegisteredCounter("netstore.scheduler.queue-depth", nil)
+	metricsSchedulerActive     = metrics.NewRegisteredCounter("netstore.scheduler.active-workers", nil)
+)
+
+func metricsSchedulerWaitTimer(p Priority) metrics.Timer {
+	return metrics.GetOrRegisterTimer(fmt.Sprintf("netstore.scheduler.wait.%d", p), nil)
+}
+
+// fetchJob is a single pending request to fetch addr from the network,
+// coalesced from every upstream requester asking for the same address.
+type fetchJob struct {
+	key      string
+	addr     Address
+	ctx      context.Context
+	priority Priority
+	fetch    FetchFunc
+	queuedAt time.Time
+}
+
+// fetchScheduler serializes outbound fetch requests from every fetcher
+// through a bounded pool of worker goroutines, always handing the next free
+// worker the highest-priority job pending. It coalesces repeated scheduling
+// of the same address into a single queued job, only ever raising that
+// job's priority as higher-priority requests come in.
+type fetchScheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues [priorityCount][]*fetchJob
+	queued map[string]*fetchJob
+}
+
+// newFetchScheduler starts a fetchScheduler backed by concurrency worker
+// goroutines.
+func newFetchScheduler(concurrency int) *fetchScheduler {
+	if concurrency <= 0 {
+		concurrency = defaultFetcherConcurrency
+	}
+	s := &fetchScheduler{
+		queued: make(map[string]*fetchJob),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < concurrency; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// schedule enqueues a fetch job for addr at the given priority, or - if a
+// job for addr is already queued - upgrades that job's priority, never
+// downgrading it.
+func (s *fetchScheduler) schedule(addr Address, priority Priority, ctx context.Context, fetch FetchFunc) {
+	key := hex.EncodeToString(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.queued[key]; ok {
+		if priority > job.priority {
+			s.removeQueuedLocked(job)
+			job.priority = priority
+			s.queues[priority] = append(s.queues[priority], job)
+			s.queued[key] = job
+			s.cond.Signal()
+		}
+		return
+	}
+
+	job := &fetchJob{
+		key:      key,
+		addr:     addr,
+		ctx:      ctx,
+		priority: priority,
+		fetch:    fetch,
+		queuedAt: time.Now(),
+	}
+	s.queued[key] = job
+	s.queues[priority] = append(s.queues[priority], job)
+	metricsSchedulerQueueDepth.Inc(1)
+	s.cond.Signal()
+}
+
+// removeQueuedLocked removes job from its current priority band. Callers
+// must hold s.mu.
+func (s *fetchScheduler) removeQueuedLocked(job *fetchJob) {
+	q := s.queues[job.priority]
+	for i, j := range q {
+		if j == job {
+			s.queues[job.priority] = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextLocked pops and returns the highest-priority pending job, blocking
+// until one is available. Callers must hold s.mu.
+func (s *fetchScheduler) nextLocked() *fetchJob {
+	for {
+		for p := priorityCount - 1; p >= 0; p-- {
+			if q := s.queues[p]; len(q) > 0 {
+				job := q[0]
+				s.queues[p] = q[1:]
+				delete(s.queued, job.key)
+				metricsSchedulerQueueDepth.Dec(1)
+				return job
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+// worker repeatedly pops the highest-priority job and runs its fetch
+// function, tracking per-priority wait latency and worker utilization.
+func (s *fetchScheduler) worker() {
+	for {
+		s.mu.Lock()
+		job := s.nextLocked()
+		s.mu.Unlock()
+
+		metricsSchedulerWaitTimer(job.priority).UpdateSince(job.queuedAt)
+		metricsSchedulerActive.Inc(1)
+		job.fetch(job.ctx)
+		metricsSchedulerActive.Dec(1)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFetchSchedulerPriorityOrder checks that, with only a single worker, a
+// low priority job queued before a high priority one is still served after
+// it when both are pending at the same time.
+func TestFetchSchedulerPriorityOrder(t *testing.T) {
+	s := newFetchScheduler(1)
+
+	var mu sync.Mutex
+	var order []string
+
+	block := make(chan struct{})
+	done := make(chan struct{})
+
+	// occupy the single worker so both jobs below are queued, not yet run
+	s.schedule(Address([]byte("addr-block")), PriorityUserRequest, context.Background(), func(ctx context.Context) {
+		<-block
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	record := func(name string) FetchFunc {
+		return func(ctx context.Context) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			if len(order) == 2 {
+				close(done)
+			}
+		}
+	}
+	s.schedule(Address([]byte("addr-low")), PriorityOpportunistic, context.Background(), record("low"))
+	s.schedule(Address([]byte("addr-high")), PriorityUserRequest, context.Background(), record("high"))
+
+	close(block)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for both jobs to run")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "high" || order[1] != "low" {
+		t.Fatalf("expected high priority job to run before low priority job, got %v", order)
+	}
+}
+
+// TestFetchSchedulerCoalescesAndUpgradesPriority checks that scheduling the
+// same address twice results in a single queued job whose priority is
+// upgraded, never downgraded.
+func TestFetchSchedulerCoalescesAndUpgradesPriority(t *testing.T) {
+	s := newFetchScheduler(1)
+
+	// occupy the single worker so the jobs below stay queued, not yet run
+	block := make(chan struct{})
+	defer close(block)
+	s.schedule(Address([]byte("addr-block")), PriorityUserRequest, context.Background(), func(ctx context.Context) {
+		<-block
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	addr := Address([]byte("addr-coalesce"))
+	s.schedule(addr, PriorityOpportunistic, context.Background(), func(ctx context.Context) {})
+
+	s.mu.Lock()
+	job := s.queued[hex.EncodeToString(addr)]
+	s.mu.Unlock()
+	if job == nil {
+		t.Fatal("expected job to be queued")
+	}
+
+	s.schedule(addr, PriorityUserRequest, context.Background(), func(ctx context.Context) {})
+	s.mu.Lock()
+	if len(s.queued) != 1 {
+		s.mu.Unlock()
+		t.Fatalf("expected scheduling the same address twice to coalesce into one job, got %d", len(s.queued))
+	}
+	if s.queued[hex.EncodeToString(addr)].priority != PriorityUserRequest {
+		priority := s.queued[hex.EncodeToString(addr)].priority
+		s.mu.Unlock()
+		t.Fatalf("expected job priority to be upgraded to PriorityUserRequest, got %v", priority)
+	}
+	s.mu.Unlock()
+
+	// downgrading must not happen - release the lock before scheduling again,
+	// since schedule takes it itself and sync.Mutex is not reentrant
+	s.schedule(addr, PriorityOpportunistic, context.Background(), func(ctx context.Context) {})
+	s.mu.Lock()
+	priority := s.queued[hex.EncodeToString(addr)].priority
+	s.mu.Unlock()
+	if priority != PriorityUserRequest {
+		t.Fatal("priority must never be downgraded")
+	}
+}